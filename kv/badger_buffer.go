@@ -0,0 +1,560 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/goleveldb/leveldb/comparer"
+	"github.com/pingcap/goleveldb/leveldb/memdb"
+	"github.com/pingcap/goleveldb/leveldb/util"
+	"github.com/sirupsen/logrus"
+)
+
+// BadgerSpillThreshold is the buffered size, in bytes, at which a
+// badgerMemBuffer stops keeping entries in its in-memory arena and starts
+// writing them into an on-disk Badger instance with value-log separation.
+var BadgerSpillThreshold = 512 * 1024 * 1024
+
+// badgerMigrateBatchSize caps how many entries maybeSpill commits per Badger
+// transaction while migrating the in-memory arena. Badger rejects a
+// transaction once it holds too many entries or bytes (ErrTxnTooBig), and an
+// arena up to BadgerSpillThreshold in size comfortably exceeds that limit, so
+// the migration has to be split across multiple commits rather than done in
+// one db.Update call.
+var badgerMigrateBatchSize = 1000
+
+// badgerMemBuffer is a MemBuffer implementation for large transactions. It
+// behaves exactly like memDbBuffer while its buffered size stays below
+// BadgerSpillThreshold; once the threshold is crossed it migrates every
+// buffered entry into a Badger instance rooted at a temp directory and
+// keeps writing there, which keeps the process heap bounded for multi-GB
+// IMPORT / bulk INSERT transactions.
+type badgerMemBuffer struct {
+	sync.Mutex
+
+	mem *memdb.DB // used until spilled becomes true
+
+	db      *badger.DB // non-nil once spilled
+	dir     string
+	spilled bool
+	// count mirrors mem.Len() once spilled, so Len() doesn't have to
+	// iterate the whole on-disk instance on every call.
+	count int
+	// byteSize mirrors mem.Size() once spilled, i.e. the logical sum of
+	// every buffered key's and value's length. db.Size() reports on-disk
+	// LSM+vlog bytes instead, which is a different number (compression,
+	// value-log overhead, not-yet-compacted garbage) and would make Size()
+	// compare apples to oranges against bufferSizeLimit.
+	byteSize int
+
+	entrySizeLimit  int
+	bufferLenLimit  uint64
+	bufferSizeLimit int
+}
+
+// NewBadgerMemBuffer creates a MemBuffer that starts out arena-backed and
+// spills to a temp Badger instance once BadgerSpillThreshold is exceeded.
+func NewBadgerMemBuffer(cap int) MemBuffer {
+	logrus.Printf("new badgerMemBuffer with cap[%d]", cap)
+	return &badgerMemBuffer{
+		mem:             memdb.New(comparer.DefaultComparer, cap),
+		entrySizeLimit:  TxnEntrySizeLimit,
+		bufferLenLimit:  atomicLoadTxnEntryCountLimit(),
+		bufferSizeLimit: TxnTotalSizeLimit,
+	}
+}
+
+func atomicLoadTxnEntryCountLimit() uint64 {
+	return atomic.LoadUint64(&TxnEntryCountLimit)
+}
+
+// maybeSpill migrates the in-memory arena into a fresh Badger instance the
+// first time the buffered size crosses BadgerSpillThreshold. It must be
+// called with the lock held.
+func (b *badgerMemBuffer) maybeSpill() error {
+	if b.spilled || b.mem.Size() < BadgerSpillThreshold {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "tidb-membuf-badger")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		return errors.Trace(err)
+	}
+	if err := migrateMemdbToBadger(db, b.mem); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		return errors.Trace(err)
+	}
+	logrus.Infof("membuf spilled to badger at %s, size=%d", dir, b.mem.Size())
+	b.count = b.mem.Len()
+	b.byteSize = b.mem.Size()
+	b.db = db
+	b.dir = dir
+	b.spilled = true
+	b.mem = memdb.New(comparer.DefaultComparer, 0)
+	// Safety net: if the transaction is simply abandoned (the normal abort
+	// path) without an explicit Reset/Close, don't leak the spilled dir.
+	runtime.SetFinalizer(b, (*badgerMemBuffer).finalize)
+	return nil
+}
+
+// migrateMemdbToBadger copies every entry of mem into db, committing every
+// badgerMigrateBatchSize entries (and immediately retrying in a fresh
+// transaction on ErrTxnTooBig) instead of doing the whole migration in a
+// single transaction, which Badger would reject once mem holds more entries
+// or bytes than a transaction is allowed to carry.
+func migrateMemdbToBadger(db *badger.DB, mem *memdb.DB) error {
+	iter := mem.NewIterator(&util.Range{})
+	txn := db.NewTransaction(true)
+	n := 0
+	for iter.Next() {
+		k := append([]byte{}, iter.Key()...)
+		v := append([]byte{}, iter.Value()...)
+		if err := txn.Set(k, v); err == badger.ErrTxnTooBig {
+			if err := txn.Commit(nil); err != nil {
+				return err
+			}
+			txn = db.NewTransaction(true)
+			n = 0
+			if err := txn.Set(k, v); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		n++
+		if n >= badgerMigrateBatchSize {
+			if err := txn.Commit(nil); err != nil {
+				return err
+			}
+			txn = db.NewTransaction(true)
+			n = 0
+		}
+	}
+	return txn.Commit(nil)
+}
+
+// finalize is registered as b's finalizer once it has spilled to disk. It
+// only runs if the buffer became unreachable without Reset/Close having
+// run first, which normally means the owning transaction was abandoned
+// rather than committed or rolled back cleanly.
+func (b *badgerMemBuffer) finalize() {
+	b.Lock()
+	defer b.Unlock()
+	if b.spilled {
+		logrus.Warnf("badgerMemBuffer garbage collected without Reset/Close, cleaning up spilled dir %s", b.dir)
+		b.closeSpill()
+	}
+}
+
+// Seek creates an Iterator over the buffer in sorted key order.
+func (b *badgerMemBuffer) Seek(k Key) (Iterator, error) {
+	b.Lock()
+	defer b.Unlock()
+	if !b.spilled {
+		var i Iterator
+		if k == nil {
+			i = &memDbIter{iter: b.mem.NewIterator(&util.Range{}), reverse: false}
+		} else {
+			i = &memDbIter{iter: b.mem.NewIterator(&util.Range{Start: []byte(k)}), reverse: false}
+		}
+		if err := i.Next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return i, nil
+	}
+	return b.newBadgerIter(k, false)
+}
+
+// SeekReverse creates a reverse Iterator over the buffer.
+func (b *badgerMemBuffer) SeekReverse(k Key) (Iterator, error) {
+	b.Lock()
+	defer b.Unlock()
+	if !b.spilled {
+		var i *memDbIter
+		if k == nil {
+			i = &memDbIter{iter: b.mem.NewIterator(&util.Range{}), reverse: true}
+		} else {
+			i = &memDbIter{iter: b.mem.NewIterator(&util.Range{Limit: []byte(k)}), reverse: true}
+		}
+		i.iter.Last()
+		return i, nil
+	}
+	return b.newBadgerIter(k, true)
+}
+
+func (b *badgerMemBuffer) newBadgerIter(k Key, reverse bool) (Iterator, error) {
+	txn := b.db.NewTransaction(false)
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+	it := txn.NewIterator(opts)
+	if k == nil {
+		it.Rewind()
+	} else {
+		it.Seek(k)
+	}
+	return &badgerIter{txn: txn, iter: it}, nil
+}
+
+// SetCap is a no-op, mirroring memDbBuffer.
+func (b *badgerMemBuffer) SetCap(cap int) {}
+
+// Get returns the value associated with key.
+func (b *badgerMemBuffer) Get(k Key) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	if !b.spilled {
+		v, err := b.mem.Get(k)
+		if err != nil {
+			return nil, ErrNotExist
+		}
+		return v, nil
+	}
+	var val []byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(k)
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return val, nil
+}
+
+// checkEntrySize rejects entries larger than entrySizeLimit. It is shared
+// by Set and Write so a batched write can't slip an oversized entry past
+// the same check a single Set would have enforced.
+func (b *badgerMemBuffer) checkEntrySize(k Key, v []byte) error {
+	if len(k)+len(v) > b.entrySizeLimit {
+		return ErrEntryTooLarge.Gen("entry too large, size: %d", len(k)+len(v))
+	}
+	return nil
+}
+
+// Set associates key with value, spilling to disk once the arena grows past
+// BadgerSpillThreshold.
+func (b *badgerMemBuffer) Set(k Key, v []byte) error {
+	if len(v) == 0 {
+		return errors.Trace(ErrCannotSetNilValue)
+	}
+	if err := b.checkEntrySize(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	b.Lock()
+	defer b.Unlock()
+	if err := b.put(k, v); err != nil {
+		return errors.Trace(err)
+	}
+	if b.size() > b.bufferSizeLimit {
+		return ErrTxnTooLarge.Gen("transaction too large, size:%d", b.size())
+	}
+	if b.length() > int(b.bufferLenLimit) {
+		return ErrTxnTooLarge.Gen("transaction too large, len:%d", b.length())
+	}
+	return nil
+}
+
+// Delete removes the entry from buffer with provided key.
+func (b *badgerMemBuffer) Delete(k Key) error {
+	b.Lock()
+	defer b.Unlock()
+	return errors.Trace(b.put(k, nil))
+}
+
+// Write applies every record of batch atomically: every record is
+// validated against entrySizeLimit before any of them is applied, so a
+// batch that fails partway through leaves b untouched rather than having
+// already written and possibly spilled the records that came before the
+// bad one. A Put record with an empty value is rejected here too, matching
+// Set: without this check it would be indistinguishable from a Delete
+// tombstone once applied. Once the buffer has spilled, the batch is applied
+// through putBatchSpilled, which commits one Badger transaction for the
+// whole batch rather than one per key as long as Badger accepts the batch
+// in a single transaction. When Badger rejects it as too big, the records
+// applied so far are committed on their own and the rest go into a new
+// transaction, so a Badger error after such a split leaves the earlier
+// records applied; an error before any split commits none of them.
+func (b *badgerMemBuffer) Write(batch *WriteBatch) error {
+	b.Lock()
+	defer b.Unlock()
+	err := batch.Iterate(func(k Key, v []byte, isDelete bool) error {
+		if isDelete {
+			return nil
+		}
+		if len(v) == 0 {
+			return errors.Trace(ErrCannotSetNilValue)
+		}
+		return b.checkEntrySize(k, v)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if b.spilled {
+		if err := b.putBatchSpilled(batch); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		err = batch.Iterate(func(k Key, v []byte, isDelete bool) error {
+			if isDelete {
+				return b.mem.Put(k, nil)
+			}
+			return b.mem.Put(k, v)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := b.maybeSpill(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if b.size() > b.bufferSizeLimit {
+		return ErrTxnTooLarge.Gen("transaction too large, size:%d", b.size())
+	}
+	if b.length() > int(b.bufferLenLimit) {
+		return ErrTxnTooLarge.Gen("transaction too large, len:%d", b.length())
+	}
+	return nil
+}
+
+// putBatchSpilled applies every record of batch to the spilled Badger
+// instance inside a single transaction, splitting into an additional
+// commit only when Badger rejects the transaction as too big (the same
+// ErrTxnTooBig retry migrateMemdbToBadger uses), so a normally sized batch
+// pays exactly one transaction commit instead of one per key. Must be
+// called with the lock held and b.spilled true.
+func (b *badgerMemBuffer) putBatchSpilled(batch *WriteBatch) error {
+	txn := b.db.NewTransaction(true)
+	apply := func(k, v []byte) error {
+		for {
+			var prevSize int
+			existed := false
+			if item, err := txn.Get(k); err == nil {
+				existed = true
+				prevSize = len(k) + int(item.ValueSize())
+			}
+			err := txn.Set(k, v)
+			if err == badger.ErrTxnTooBig {
+				if err := txn.Commit(nil); err != nil {
+					return err
+				}
+				txn = b.db.NewTransaction(true)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !existed {
+				b.count++
+			} else {
+				b.byteSize -= prevSize
+			}
+			b.byteSize += len(k) + len(v)
+			return nil
+		}
+	}
+	err := batch.Iterate(func(k Key, v []byte, isDelete bool) error {
+		kk := append([]byte{}, k...)
+		if isDelete {
+			return apply(kk, nil)
+		}
+		return apply(kk, append([]byte{}, v...))
+	})
+	if err != nil {
+		return err
+	}
+	return txn.Commit(nil)
+}
+
+// put writes k/v (v == nil means tombstone), keeps count in sync and
+// spills if necessary. Must be called with the lock held.
+func (b *badgerMemBuffer) put(k Key, v []byte) error {
+	if !b.spilled {
+		if err := b.mem.Put(k, v); err != nil {
+			return err
+		}
+		return b.maybeSpill()
+	}
+	var prevSize int
+	existed := false
+	err := b.db.Update(func(txn *badger.Txn) error {
+		if item, err := txn.Get(k); err == nil {
+			existed = true
+			prevSize = len(k) + int(item.ValueSize())
+		}
+		return txn.Set(append([]byte{}, k...), append([]byte{}, v...))
+	})
+	if err != nil {
+		return err
+	}
+	if !existed {
+		b.count++
+	} else {
+		b.byteSize -= prevSize
+	}
+	b.byteSize += len(k) + len(v)
+	return nil
+}
+
+// removeFromBuffer drops k entirely, as opposed to Delete, which leaves a
+// tombstone behind. It implements bufferRemover for BufferStore.RollbackTo.
+func (b *badgerMemBuffer) removeFromBuffer(k Key) error {
+	b.Lock()
+	defer b.Unlock()
+	if !b.spilled {
+		return errors.Trace(b.mem.Delete(k))
+	}
+	var prevSize int
+	existed := false
+	err := b.db.Update(func(txn *badger.Txn) error {
+		if item, err := txn.Get(k); err == nil {
+			existed = true
+			prevSize = len(k) + int(item.ValueSize())
+		}
+		return txn.Delete(k)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if existed {
+		b.count--
+		b.byteSize -= prevSize
+	}
+	return nil
+}
+
+// Size returns sum of keys and values length.
+func (b *badgerMemBuffer) Size() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.size()
+}
+
+func (b *badgerMemBuffer) size() int {
+	if !b.spilled {
+		return b.mem.Size()
+	}
+	// byteSize is kept up to date incrementally in put()/removeFromBuffer(),
+	// mirroring how count tracks Len() post-spill: it is the logical sum of
+	// buffered keys' and values' lengths, not db.Size()'s on-disk LSM+vlog
+	// byte count, so it stays comparable to bufferSizeLimit the same way it
+	// was pre-spill.
+	return b.byteSize
+}
+
+// Len returns the number of entries in the buffer.
+func (b *badgerMemBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.length()
+}
+
+func (b *badgerMemBuffer) length() int {
+	if !b.spilled {
+		return b.mem.Len()
+	}
+	// count is kept up to date incrementally in put(); scanning the whole
+	// on-disk instance here would make every Set/Write on a spilled,
+	// multi-GB import O(n) by itself, i.e. O(n^2) overall.
+	return b.count
+}
+
+// Reset cleans up the buffer, removing any spilled Badger files on disk.
+func (b *badgerMemBuffer) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.mem.Reset()
+	b.closeSpill()
+}
+
+// closeSpill closes and removes the on-disk Badger instance, if any. Must be
+// called with the lock held.
+func (b *badgerMemBuffer) closeSpill() {
+	if !b.spilled {
+		return
+	}
+	if err := b.db.Close(); err != nil {
+		logrus.Warnf("failed to close spilled badger membuf: %v", err)
+	}
+	if err := os.RemoveAll(b.dir); err != nil {
+		logrus.Warnf("failed to remove spilled badger dir %s: %v", b.dir, err)
+	}
+	b.db = nil
+	b.dir = ""
+	b.spilled = false
+	runtime.SetFinalizer(b, nil)
+}
+
+// Close releases the buffer's resources. It must be called when the buffer
+// is abandoned (e.g. on transaction abort) so a spilled temp directory is
+// not leaked.
+func (b *badgerMemBuffer) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	b.closeSpill()
+	return nil
+}
+
+type badgerIter struct {
+	txn  *badger.Txn
+	iter *badger.Iterator
+}
+
+func (i *badgerIter) Next() error {
+	i.iter.Next()
+	return nil
+}
+
+func (i *badgerIter) Valid() bool {
+	return i.iter.Valid()
+}
+
+func (i *badgerIter) Key() Key {
+	return Key(i.iter.Item().Key())
+}
+
+func (i *badgerIter) Value() []byte {
+	v, err := i.iter.Item().ValueCopy(nil)
+	if err != nil {
+		logrus.Warnf("badgerIter value copy failed: %v", err)
+		return nil
+	}
+	return v
+}
+
+func (i *badgerIter) Close() {
+	i.iter.Close()
+	i.txn.Discard()
+}
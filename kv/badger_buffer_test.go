@@ -0,0 +1,193 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"os"
+	"testing"
+)
+
+// withLowSpillThreshold lowers BadgerSpillThreshold for the duration of a
+// test so a handful of small entries is enough to force a spill, and
+// restores the previous value afterwards.
+func withLowSpillThreshold(t *testing.T, threshold int) {
+	old := BadgerSpillThreshold
+	BadgerSpillThreshold = threshold
+	t.Cleanup(func() { BadgerSpillThreshold = old })
+}
+
+func TestBadgerMemBufferSpillsAndPreservesContents(t *testing.T) {
+	withLowSpillThreshold(t, 1)
+
+	b := NewBadgerMemBuffer(0).(*badgerMemBuffer)
+	defer b.Close()
+
+	if err := b.Set(Key("a"), []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := b.Set(Key("b"), []byte("2")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if !b.spilled {
+		t.Fatal("expected buffer to have spilled to disk")
+	}
+	dir := b.dir
+	if dir == "" {
+		t.Fatal("expected spilled dir to be set")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected spilled dir to exist on disk, got: %v", err)
+	}
+
+	v, err := b.Get(Key("a"))
+	if err != nil || string(v) != "1" {
+		t.Fatalf("expected %q for key a after spill, got %q, err %v", "1", v, err)
+	}
+	if b.Len() != 2 {
+		t.Fatalf("expected Len()==2 after spill, got %d", b.Len())
+	}
+	if b.Size() <= 0 {
+		t.Fatalf("expected Size() > 0 after spill, got %d", b.Size())
+	}
+
+	it, err := b.Seek(nil)
+	if err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	var gotKeys []string
+	for it.Valid() {
+		gotKeys = append(gotKeys, string(it.Key()))
+		if err := it.Next(); err != nil {
+			t.Fatalf("iterator Next failed: %v", err)
+		}
+	}
+	if len(gotKeys) != 2 || gotKeys[0] != "a" || gotKeys[1] != "b" {
+		t.Fatalf("expected Seek to yield [a b] in order, got %v", gotKeys)
+	}
+}
+
+func TestBadgerMemBufferWriteRejectsEmptyValue(t *testing.T) {
+	b := NewBadgerMemBuffer(0).(*badgerMemBuffer)
+	defer b.Close()
+
+	batch := NewWriteBatch()
+	batch.Put(Key("k"), []byte{})
+
+	err := b.Write(batch)
+	if err == nil {
+		t.Fatal("expected Write to reject a Put with an empty value, like Set does")
+	}
+	if _, getErr := b.Get(Key("k")); !IsErrNotFound(getErr) {
+		t.Fatalf("rejected entry must not have been applied, got %v", getErr)
+	}
+}
+
+func TestBadgerMemBufferSpilledWriteAppliesBatch(t *testing.T) {
+	withLowSpillThreshold(t, 1)
+
+	b := NewBadgerMemBuffer(0).(*badgerMemBuffer)
+	defer b.Close()
+
+	if err := b.Set(Key("seed"), []byte("v")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if !b.spilled {
+		t.Fatal("expected buffer to have spilled to disk")
+	}
+
+	batch := NewWriteBatch()
+	batch.Put(Key("a"), []byte("1"))
+	batch.Put(Key("b"), []byte("2"))
+	if err := b.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if b.Len() != 3 {
+		t.Fatalf("expected Len()==3 after batch, got %d", b.Len())
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		v, err := b.Get(Key(k))
+		if err != nil || string(v) != want {
+			t.Fatalf("expected %q for key %s, got %q, err %v", want, k, v, err)
+		}
+	}
+}
+
+func TestBadgerMemBufferSizeTracksLogicalBytesAfterSpill(t *testing.T) {
+	withLowSpillThreshold(t, 1)
+
+	b := NewBadgerMemBuffer(0).(*badgerMemBuffer)
+	defer b.Close()
+
+	if err := b.Set(Key("a"), []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if !b.spilled {
+		t.Fatal("expected buffer to have spilled to disk")
+	}
+	want := len(Key("a")) + len("1")
+	if got := b.Size(); got != want {
+		t.Fatalf("expected Size()==%d after spill, got %d", want, got)
+	}
+
+	// Overwriting the key with a longer value must update byteSize by the
+	// delta, not double-count the key's old length.
+	if err := b.Set(Key("a"), []byte("12345")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	want = len(Key("a")) + len("12345")
+	if got := b.Size(); got != want {
+		t.Fatalf("expected Size()==%d after overwrite, got %d", want, got)
+	}
+}
+
+func TestBadgerMemBufferResetRemovesSpilledDir(t *testing.T) {
+	withLowSpillThreshold(t, 1)
+
+	b := NewBadgerMemBuffer(0).(*badgerMemBuffer)
+
+	if err := b.Set(Key("a"), []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if !b.spilled {
+		t.Fatal("expected buffer to have spilled to disk")
+	}
+	dir := b.dir
+
+	b.Reset()
+
+	if b.spilled {
+		t.Fatal("expected Reset to clear spilled state")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected spilled dir %s to be removed after Reset, stat err: %v", dir, err)
+	}
+}
+
+func TestBadgerMemBufferCloseRemovesSpilledDir(t *testing.T) {
+	withLowSpillThreshold(t, 1)
+
+	b := NewBadgerMemBuffer(0).(*badgerMemBuffer)
+
+	if err := b.Set(Key("a"), []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	dir := b.dir
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected spilled dir %s to be removed after Close, stat err: %v", dir, err)
+	}
+}
@@ -28,6 +28,43 @@ var (
 	TempTxnMemBufCap = 64
 )
 
+// SavepointID identifies a point in a BufferStore's write history that
+// RollbackTo can later restore.
+type SavepointID int64
+
+// undoState is the state a key was in immediately before the first
+// mutation made after a savepoint was taken. The MemBuffer represents
+// three distinct states for a key (absent, tombstoned via Delete, or set
+// to a real value), and RollbackTo has to replay each of them differently:
+// Set rejects zero-length values, and Delete would wrongly turn "absent"
+// into a tombstone that permanently shadows the underlying Retriever.
+type undoState int
+
+const (
+	// undoAbsent means the key was not present in the MemBuffer at all, so
+	// rolling back must remove it from the MemBuffer entirely rather than
+	// writing any kind of record for it.
+	undoAbsent undoState = iota
+	// undoTombstone means the key was present in the MemBuffer as a
+	// Delete tombstone, so rolling back replays Delete.
+	undoTombstone
+	// undoValue means the key held a real value, so rolling back replays
+	// Set with that value.
+	undoValue
+)
+
+type undoRecord struct {
+	state undoState
+	value []byte
+}
+
+// savepoint accumulates undo records for every key mutated after it was
+// taken. Savepoints are kept on a stack so they nest correctly.
+type savepoint struct {
+	id   SavepointID
+	undo map[string]undoRecord
+}
+
 // BufferStore wraps a Retriever for read and a MemBuffer for buffered write.
 // Common usage pattern:
 //	bs := NewBufferStore(r) // use BufferStore to wrap a Retriever
@@ -38,6 +75,11 @@ var (
 type BufferStore struct {
 	MemBuffer
 	r Retriever
+
+	savepointSeq SavepointID
+	savepoints   []*savepoint
+
+	readCache *readCache
 }
 
 // NewBufferStore creates a BufferStore using r for read.
@@ -52,9 +94,208 @@ func NewBufferStore(r Retriever, cap int) *BufferStore {
 	}
 }
 
-// Reset resets s.MemBuffer.
+// NewBufferStoreWithMemBufferKind creates a BufferStore whose MemBuffer is
+// built by NewMemBuffer(kind, cap) instead of the leveldb-backed
+// lazyMemBuffer NewBufferStore always uses. This is the actual per-session
+// selection point for MemBufferKindBadger: callers that know a transaction
+// is going to be large (e.g. IMPORT / bulk INSERT) construct their
+// BufferStore through here.
+func NewBufferStoreWithMemBufferKind(r Retriever, kind MemBufferKind, cap int) *BufferStore {
+	logrus.Infof("new BufferStore with Retriever[%s],cap[%d],kind[%d]", reflect.TypeOf(r), cap, kind)
+	if cap <= 0 {
+		cap = DefaultTxnMembufCap
+	}
+	return &BufferStore{
+		r:         r,
+		MemBuffer: NewMemBuffer(kind, cap),
+	}
+}
+
+// NewBufferStoreWithReadCache creates a BufferStore backed by a bounded
+// read-through LRU cache sitting between its MemBuffer and r. Point
+// lookups that repeatedly miss the MemBuffer and fall through to r (e.g.
+// row-format reads during index lookups on a long-running transaction)
+// are served from the cache instead of hitting r again. The cache is
+// populated only on Retriever.Get misses and is invalidated whenever the
+// same key is written through Set or Delete; Seek/SeekReverse never touch
+// it, so range scans cannot evict the point-lookup working set.
+func NewBufferStoreWithReadCache(r Retriever, memCap, readCacheEntries int) *BufferStore {
+	bs := NewBufferStore(r, memCap)
+	bs.readCache = newReadCache(readCacheEntries)
+	bs.r = &cachedRetriever{Retriever: r, cache: bs.readCache}
+	return bs
+}
+
+// Reset resets s.MemBuffer and drops any outstanding savepoints.
 func (s *BufferStore) Reset() {
 	s.MemBuffer.Reset()
+	s.savepoints = nil
+}
+
+// Set associates key with value, recording an undo record for the
+// innermost (most recently taken) open savepoint, if any, before the value
+// is overwritten.
+func (s *BufferStore) Set(k Key, v []byte) error {
+	s.recordUndo(k)
+	if s.readCache != nil {
+		s.readCache.invalidate(k)
+	}
+	return errors.Trace(s.MemBuffer.Set(k, v))
+}
+
+// Delete removes the entry from buffer with provided key, recording an
+// undo record for the innermost (most recently taken) open savepoint, if
+// any, first.
+func (s *BufferStore) Delete(k Key) error {
+	s.recordUndo(k)
+	if s.readCache != nil {
+		s.readCache.invalidate(k)
+	}
+	return errors.Trace(s.MemBuffer.Delete(k))
+}
+
+// Write applies every record in b, recording an undo record for the
+// innermost open savepoint and invalidating the read cache for each
+// mutated key first, exactly as Set/Delete do. Without this override,
+// WriteBatch callers going through the embedded MemBuffer directly would
+// bypass both, and RollbackTo would silently leave batched keys at their
+// post-batch state.
+//
+// This relies on s.MemBuffer.Write existing on whatever concrete type
+// lazyMemBuffer resolves to at the kv.go declaration this file's MemBuffer
+// embedding points at; that file isn't part of this tree (it was already
+// missing at the very first commit, same as the MemBuffer interface
+// declaration itself), so it can't be verified here. Every MemBuffer
+// backend that does live in this tree - memDbBuffer, badgerMemBuffer -
+// implements Write with matching semantics, so lazyMemBuffer, whatever it
+// turns out to be, needs the same method to satisfy the interface.
+func (s *BufferStore) Write(b *WriteBatch) error {
+	err := b.Iterate(func(k Key, v []byte, isDelete bool) error {
+		s.recordUndo(k)
+		if s.readCache != nil {
+			s.readCache.invalidate(k)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.MemBuffer.Write(b))
+}
+
+// recordUndo captures the value k had in the MemBuffer right before its
+// first mutation since the topmost savepoint was taken. Later mutations of
+// the same key within the same savepoint are not recorded again, since
+// RollbackTo only ever needs to restore the earliest known state.
+func (s *BufferStore) recordUndo(k Key) {
+	if len(s.savepoints) == 0 {
+		return
+	}
+	sp := s.savepoints[len(s.savepoints)-1]
+	sk := string(k)
+	if _, ok := sp.undo[sk]; ok {
+		return
+	}
+	v, err := s.MemBuffer.Get(k)
+	switch {
+	case IsErrNotFound(err):
+		sp.undo[sk] = undoRecord{state: undoAbsent}
+	case len(v) == 0:
+		sp.undo[sk] = undoRecord{state: undoTombstone}
+	default:
+		sp.undo[sk] = undoRecord{state: undoValue, value: v}
+	}
+}
+
+// Savepoint records the current state of the buffer and returns an ID that
+// can later be passed to RollbackTo or Release. Savepoints nest: taking one
+// while another is open starts a new frame on top of it.
+func (s *BufferStore) Savepoint() SavepointID {
+	s.savepointSeq++
+	s.savepoints = append(s.savepoints, &savepoint{
+		id:   s.savepointSeq,
+		undo: make(map[string]undoRecord),
+	})
+	return s.savepointSeq
+}
+
+// bufferRemover is implemented by MemBuffer backends that can drop a key
+// from the buffer entirely, as opposed to Delete, which leaves a
+// tombstone behind. RollbackTo needs this to restore a key that was
+// undoAbsent (not present in the buffer before the savepoint) back to
+// that exact state; replaying it as a Delete would incorrectly shadow
+// whatever value the underlying Retriever holds for that key.
+type bufferRemover interface {
+	removeFromBuffer(k Key) error
+}
+
+// RollbackTo undoes every Set/Delete made since the given savepoint was
+// taken, discarding any nested savepoints taken after it. The savepoint
+// itself remains open and can be rolled back to again.
+func (s *BufferStore) RollbackTo(id SavepointID) error {
+	idx := s.savepointIndex(id)
+	if idx < 0 {
+		return errors.Errorf("savepoint %d not found", id)
+	}
+	remover, canRemove := s.MemBuffer.(bufferRemover)
+	for i := len(s.savepoints) - 1; i >= idx; i-- {
+		for sk, rec := range s.savepoints[i].undo {
+			var err error
+			switch rec.state {
+			case undoValue:
+				err = s.MemBuffer.Set(Key(sk), rec.value)
+			case undoTombstone:
+				err = s.MemBuffer.Delete(Key(sk))
+			case undoAbsent:
+				if !canRemove {
+					return errors.Errorf("cannot roll back savepoint %d: MemBuffer does not support key removal", id)
+				}
+				err = remover.removeFromBuffer(Key(sk))
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if s.readCache != nil {
+				s.readCache.invalidate(Key(sk))
+			}
+		}
+	}
+	s.savepoints = s.savepoints[:idx+1]
+	s.savepoints[idx].undo = make(map[string]undoRecord)
+	return nil
+}
+
+// Release forgets the given savepoint (and any nested ones taken after it)
+// without undoing anything, merging its undo log into the parent savepoint
+// so an outer RollbackTo can still restore the original values.
+func (s *BufferStore) Release(id SavepointID) error {
+	idx := s.savepointIndex(id)
+	if idx < 0 {
+		return errors.Errorf("savepoint %d not found", id)
+	}
+	if idx == 0 {
+		s.savepoints = nil
+		return nil
+	}
+	parent := s.savepoints[idx-1]
+	for i := idx; i < len(s.savepoints); i++ {
+		for sk, rec := range s.savepoints[i].undo {
+			if _, ok := parent.undo[sk]; !ok {
+				parent.undo[sk] = rec
+			}
+		}
+	}
+	s.savepoints = s.savepoints[:idx]
+	return nil
+}
+
+func (s *BufferStore) savepointIndex(id SavepointID) int {
+	for i, sp := range s.savepoints {
+		if sp.id == id {
+			return i
+		}
+	}
+	return -1
 }
 
 // SetCap sets the MemBuffer capability.
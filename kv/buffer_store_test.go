@@ -0,0 +1,212 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+// mockRetriever is a minimal Retriever backed by a plain map, used only to
+// exercise BufferStore without pulling in a real storage engine.
+type mockRetriever struct {
+	data map[string][]byte
+}
+
+func newMockRetriever() *mockRetriever {
+	return &mockRetriever{data: make(map[string][]byte)}
+}
+
+func (r *mockRetriever) Get(k Key) ([]byte, error) {
+	v, ok := r.data[string(k)]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return v, nil
+}
+
+func (r *mockRetriever) Seek(k Key) (Iterator, error) {
+	return nil, errors.New("mockRetriever: Seek not implemented")
+}
+
+func (r *mockRetriever) SeekReverse(k Key) (Iterator, error) {
+	return nil, errors.New("mockRetriever: SeekReverse not implemented")
+}
+
+func TestRollbackToRestoresKeyAbsentFromBuffer(t *testing.T) {
+	r := newMockRetriever()
+	r.data["k1"] = []byte("snapshot-value")
+	bs := NewBufferStore(r, 0)
+
+	sp := bs.Savepoint()
+	if err := bs.Set(Key("k1"), []byte("updated")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := bs.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo failed: %v", err)
+	}
+
+	v, err := bs.Get(Key("k1"))
+	if err != nil {
+		t.Fatalf("expected snapshot value to be visible after rollback, got error: %v", err)
+	}
+	if string(v) != "snapshot-value" {
+		t.Fatalf("expected %q after rollback, got %q", "snapshot-value", v)
+	}
+}
+
+func TestRollbackToInterleavedDeleteOfInsert(t *testing.T) {
+	r := newMockRetriever()
+	bs := NewBufferStore(r, 0)
+
+	if err := bs.Set(Key("k2"), []byte("inserted")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	sp := bs.Savepoint()
+	if err := bs.Delete(Key("k2")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := bs.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo failed: %v", err)
+	}
+
+	v, err := bs.Get(Key("k2"))
+	if err != nil {
+		t.Fatalf("expected inserted value after rollback, got error: %v", err)
+	}
+	if string(v) != "inserted" {
+		t.Fatalf("expected %q after rollback, got %q", "inserted", v)
+	}
+}
+
+func TestNestedSavepoints(t *testing.T) {
+	r := newMockRetriever()
+	bs := NewBufferStore(r, 0)
+
+	sp1 := bs.Savepoint()
+	if err := bs.Set(Key("a"), []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	sp2 := bs.Savepoint()
+	if err := bs.Set(Key("a"), []byte("2")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if err := bs.RollbackTo(sp2); err != nil {
+		t.Fatalf("RollbackTo sp2 failed: %v", err)
+	}
+	if v, err := bs.Get(Key("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected %q after inner rollback, got %q, err %v", "1", v, err)
+	}
+
+	if err := bs.RollbackTo(sp1); err != nil {
+		t.Fatalf("RollbackTo sp1 failed: %v", err)
+	}
+	if _, err := bs.Get(Key("a")); !IsErrNotFound(err) {
+		t.Fatalf("expected key to be absent after outer rollback, got err %v", err)
+	}
+}
+
+func TestRollbackAcrossSetCapBoundary(t *testing.T) {
+	r := newMockRetriever()
+	bs := NewBufferStore(r, 0)
+
+	sp := bs.Savepoint()
+	if err := bs.Set(Key("x"), []byte("1")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	bs.SetCap(1024)
+	if err := bs.Set(Key("x"), []byte("2")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if err := bs.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo failed: %v", err)
+	}
+	if _, err := bs.Get(Key("x")); !IsErrNotFound(err) {
+		t.Fatalf("expected key to be absent after rollback, got err %v", err)
+	}
+}
+
+func TestWriteThroughBufferStoreRecordsUndo(t *testing.T) {
+	r := newMockRetriever()
+	r.data["k4"] = []byte("snapshot-value")
+	bs := NewBufferStore(r, 0)
+
+	sp := bs.Savepoint()
+	b := NewWriteBatch()
+	b.Put(Key("k4"), []byte("updated"))
+	b.Put(Key("k5"), []byte("inserted"))
+	if err := bs.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := bs.RollbackTo(sp); err != nil {
+		t.Fatalf("RollbackTo failed: %v", err)
+	}
+
+	if v, err := bs.Get(Key("k4")); err != nil || string(v) != "snapshot-value" {
+		t.Fatalf("expected %q after rollback, got %q, err %v", "snapshot-value", v, err)
+	}
+	if _, err := bs.Get(Key("k5")); !IsErrNotFound(err) {
+		t.Fatalf("expected key inserted by the batch to be absent after rollback, got err %v", err)
+	}
+}
+
+func TestWriteThroughBufferStoreInvalidatesReadCache(t *testing.T) {
+	r := newMockRetriever()
+	r.data["k6"] = []byte("stale")
+	bs := NewBufferStoreWithReadCache(r, 0, 16)
+
+	if _, err := bs.Get(Key("k6")); err != nil {
+		t.Fatalf("expected k6 to be readable from retriever, got err %v", err)
+	}
+
+	b := NewWriteBatch()
+	b.Put(Key("k6"), []byte("fresh"))
+	if err := bs.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, _, found := bs.readCache.get(Key("k6")); found {
+		t.Fatal("expected batched write to drop k6 from the read cache")
+	}
+
+	v, err := bs.Get(Key("k6"))
+	if err != nil || string(v) != "fresh" {
+		t.Fatalf("expected %q after batched write, got %q, err %v", "fresh", v, err)
+	}
+}
+
+func TestReleaseMergesUndoIntoParent(t *testing.T) {
+	r := newMockRetriever()
+	r.data["k3"] = []byte("snapshot-value")
+	bs := NewBufferStore(r, 0)
+
+	outer := bs.Savepoint()
+	inner := bs.Savepoint()
+	if err := bs.Set(Key("k3"), []byte("updated")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := bs.Release(inner); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := bs.RollbackTo(outer); err != nil {
+		t.Fatalf("RollbackTo failed: %v", err)
+	}
+
+	v, err := bs.Get(Key("k3"))
+	if err != nil || string(v) != "snapshot-value" {
+		t.Fatalf("expected %q after outer rollback, got %q, err %v", "snapshot-value", v, err)
+	}
+}
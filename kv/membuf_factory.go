@@ -0,0 +1,68 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// MemBufferKind selects which MemBuffer implementation NewMemBuffer builds.
+type MemBufferKind int
+
+const (
+	// MemBufferKindMemDB is the classic goleveldb/memdb backed MemBuffer.
+	// It keeps every entry pinned in a Go-allocated arena and is the right
+	// choice for ordinary, short-lived transactions.
+	MemBufferKindMemDB MemBufferKind = iota
+	// MemBufferKindBadger is an LSM-backed MemBuffer that spills to a temp
+	// directory once its buffered size crosses BadgerSpillThreshold. It
+	// trades some latency for a bounded heap and is meant for long-running
+	// IMPORT / bulk INSERT transactions.
+	MemBufferKindBadger
+)
+
+// DefaultMemBufferKind is the MemBufferKind used when a session does not
+// request a specific one.
+var DefaultMemBufferKind = MemBufferKindMemDB
+
+// MemBufferFactory builds a MemBuffer with the given capacity hint.
+type MemBufferFactory func(cap int) MemBuffer
+
+var memBufferFactories = map[MemBufferKind]MemBufferFactory{
+	MemBufferKindMemDB: func(cap int) MemBuffer { return NewMemDbBuffer(cap) },
+	MemBufferKindBadger: func(cap int) MemBuffer { return NewBadgerMemBuffer(cap) },
+}
+
+// RegisterMemBufferFactory overrides the factory used for kind. It exists
+// mainly so tests and alternative storage engines can plug in their own
+// MemBuffer implementation without importing the kv package's internals.
+func RegisterMemBufferFactory(kind MemBufferKind, f MemBufferFactory) {
+	memBufferFactories[kind] = f
+}
+
+// NewMemBuffer builds a MemBuffer of the requested kind. It falls back to
+// MemBufferKindMemDB if kind has no registered factory.
+func NewMemBuffer(kind MemBufferKind, cap int) MemBuffer {
+	f, ok := memBufferFactories[kind]
+	if !ok {
+		logrus.Warnf("no MemBufferFactory registered for kind %d, falling back to memdb", kind)
+		f = memBufferFactories[MemBufferKindMemDB]
+	}
+	return f(cap)
+}
+
+// ErrUnknownMemBufferKind is returned by callers that parse a MemBufferKind
+// from a session variable and get an out-of-range value.
+var ErrUnknownMemBufferKind = errors.New("unknown mem buffer kind")
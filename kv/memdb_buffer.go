@@ -114,12 +114,61 @@ func (m *memDbBuffer) Set(k Key, v []byte) error {
 	return errors.Trace(err)
 }
 
+// Write applies every record of b atomically, doing a single size/len
+// limit check for the whole batch instead of one per record. Every record
+// is validated before any of them is applied, so a batch that fails
+// entrySizeLimit partway through leaves m untouched rather than having
+// already written the records that came before the bad one. A Put record
+// with an empty value is rejected here too, matching Set: without this
+// check it would be indistinguishable from a Delete tombstone once applied.
+func (m *memDbBuffer) Write(b *WriteBatch) error {
+	err := b.Iterate(func(k Key, v []byte, isDelete bool) error {
+		if isDelete {
+			return nil
+		}
+		if len(v) == 0 {
+			return errors.Trace(ErrCannotSetNilValue)
+		}
+		if len(k)+len(v) > m.entrySizeLimit {
+			return ErrEntryTooLarge.Gen("entry too large, size: %d", len(k)+len(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = b.Iterate(func(k Key, v []byte, isDelete bool) error {
+		if isDelete {
+			return errors.Trace(m.db.Put(k, nil))
+		}
+		return errors.Trace(m.db.Put(k, v))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if m.Size() > m.bufferSizeLimit {
+		return ErrTxnTooLarge.Gen("transaction too large, size:%d", m.Size())
+	}
+	if m.Len() > int(m.bufferLenLimit) {
+		return ErrTxnTooLarge.Gen("transaction too large, len:%d", m.Len())
+	}
+	return nil
+}
+
 // Delete removes the entry from buffer with provided key.
 func (m *memDbBuffer) Delete(k Key) error {
 	err := m.db.Put(k, nil)
 	return errors.Trace(err)
 }
 
+// removeFromBuffer drops k from the underlying memdb entirely, as opposed
+// to Delete, which leaves a tombstone (a Put with a nil value) behind. It
+// implements bufferRemover for BufferStore.RollbackTo.
+func (m *memDbBuffer) removeFromBuffer(k Key) error {
+	return errors.Trace(m.db.Delete(k))
+}
+
 // Size returns sum of keys and values length.
 func (m *memDbBuffer) Size() int {
 	return m.db.Size()
@@ -0,0 +1,229 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import "sync"
+
+// readCacheEntry is a node on the hot, cold or ghost list. Ghost entries
+// never carry a value.
+type readCacheEntry struct {
+	key       string
+	value     []byte
+	tombstone bool
+	prev      *readCacheEntry
+	next      *readCacheEntry
+}
+
+// readCache is a bounded, read-through cache for BufferStore.Get, laid out
+// like goleveldb's cache/lru.go: a hot list of proven-repeat keys, a small
+// cold (probationary) list for keys seen only once, and a key-only ghost
+// list remembering keys recently evicted from cold. Admission is what
+// makes this scan-resistant: a brand new key always lands in cold, never
+// hot, so a single pass over N distinct keys only ever cycles through the
+// small cold/ghost lists and can't touch, let alone evict, the hot list. A
+// key only reaches hot once it has been seen twice — either a second Get
+// while still in cold, or a Put for a key still remembered in ghost.
+type readCache struct {
+	mu sync.Mutex
+
+	hotCap   int
+	coldCap  int
+	ghostCap int
+
+	hot     map[string]*readCacheEntry
+	hotHead *readCacheEntry
+	hotTail *readCacheEntry
+
+	cold     map[string]*readCacheEntry
+	coldHead *readCacheEntry
+	coldTail *readCacheEntry
+
+	ghost     map[string]*readCacheEntry
+	ghostHead *readCacheEntry
+	ghostTail *readCacheEntry
+}
+
+// newReadCache creates a readCache holding up to hotCap proven-hot
+// entries, plus cold and ghost lists of hotCap/2 entries each (but never
+// fewer than 8) used to decide admission.
+func newReadCache(hotCap int) *readCache {
+	coldCap := hotCap / 2
+	if coldCap < 8 {
+		coldCap = 8
+	}
+	ghostCap := coldCap
+	return &readCache{
+		hotCap:   hotCap,
+		coldCap:  coldCap,
+		ghostCap: ghostCap,
+		hot:      make(map[string]*readCacheEntry),
+		cold:     make(map[string]*readCacheEntry),
+		ghost:    make(map[string]*readCacheEntry),
+	}
+}
+
+// get returns the cached value for k, whether it was found, and whether the
+// cached entry is a tombstone (previously deleted, i.e. known not to exist).
+// A hit against the cold list is a second touch for that key, so it is
+// promoted to hot on the spot.
+func (c *readCache) get(k Key) (v []byte, tombstone bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sk := string(k)
+	if e, found := c.hot[sk]; found {
+		c.unlink(e, &c.hotHead, &c.hotTail)
+		c.pushFront(e, &c.hotHead, &c.hotTail)
+		return e.value, e.tombstone, true
+	}
+	if e, found := c.cold[sk]; found {
+		c.unlink(e, &c.coldHead, &c.coldTail)
+		delete(c.cold, sk)
+		c.admitHot(e)
+		return e.value, e.tombstone, true
+	}
+	return nil, false, false
+}
+
+// put records the result of a Retriever.Get miss-then-fetch. It is never
+// called from Seek/SeekReverse, so range scans cannot pollute the cache.
+// A brand new key starts on probation in cold; only a key that was already
+// in cold, or is still remembered in ghost from a previous eviction, is
+// admitted straight to hot.
+func (c *readCache) put(k Key, v []byte, tombstone bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sk := string(k)
+	if e, ok := c.hot[sk]; ok {
+		e.value, e.tombstone = v, tombstone
+		c.unlink(e, &c.hotHead, &c.hotTail)
+		c.pushFront(e, &c.hotHead, &c.hotTail)
+		return
+	}
+	if e, ok := c.cold[sk]; ok {
+		e.value, e.tombstone = v, tombstone
+		c.unlink(e, &c.coldHead, &c.coldTail)
+		delete(c.cold, sk)
+		c.admitHot(e)
+		return
+	}
+	e := &readCacheEntry{key: sk, value: v, tombstone: tombstone}
+	if g, ok := c.ghost[sk]; ok {
+		c.unlink(g, &c.ghostHead, &c.ghostTail)
+		delete(c.ghost, sk)
+		c.admitHot(e)
+		return
+	}
+	c.cold[sk] = e
+	c.pushFront(e, &c.coldHead, &c.coldTail)
+	for len(c.cold) > c.coldCap && c.coldTail != nil {
+		victim := c.coldTail
+		c.unlink(victim, &c.coldHead, &c.coldTail)
+		delete(c.cold, victim.key)
+		c.addGhost(victim.key)
+	}
+}
+
+// admitHot moves e into the hot list, evicting the coldest hot entry (into
+// ghost) if that pushes hot over capacity.
+func (c *readCache) admitHot(e *readCacheEntry) {
+	c.hot[e.key] = e
+	c.pushFront(e, &c.hotHead, &c.hotTail)
+	for len(c.hot) > c.hotCap && c.hotTail != nil {
+		victim := c.hotTail
+		c.unlink(victim, &c.hotHead, &c.hotTail)
+		delete(c.hot, victim.key)
+		c.addGhost(victim.key)
+	}
+}
+
+// invalidate drops k from the cache. BufferStore calls it for every key
+// written through its Set, Delete or Write, and for every key RollbackTo
+// restores.
+func (c *readCache) invalidate(k Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sk := string(k)
+	if e, ok := c.hot[sk]; ok {
+		c.unlink(e, &c.hotHead, &c.hotTail)
+		delete(c.hot, sk)
+	}
+	if e, ok := c.cold[sk]; ok {
+		c.unlink(e, &c.coldHead, &c.coldTail)
+		delete(c.cold, sk)
+	}
+}
+
+func (c *readCache) addGhost(key string) {
+	e := &readCacheEntry{key: key}
+	c.ghost[key] = e
+	c.pushFront(e, &c.ghostHead, &c.ghostTail)
+	for len(c.ghost) > c.ghostCap && c.ghostTail != nil {
+		victim := c.ghostTail
+		c.unlink(victim, &c.ghostHead, &c.ghostTail)
+		delete(c.ghost, victim.key)
+	}
+}
+
+func (c *readCache) pushFront(e *readCacheEntry, head, tail **readCacheEntry) {
+	e.prev, e.next = nil, *head
+	if *head != nil {
+		(*head).prev = e
+	}
+	*head = e
+	if *tail == nil {
+		*tail = e
+	}
+}
+
+func (c *readCache) unlink(e *readCacheEntry, head, tail **readCacheEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		*head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		*tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+// cachedRetriever wraps a Retriever, populating a readCache on every miss
+// so a repeated Get for the same key short-circuits before reaching the
+// underlying storage.
+type cachedRetriever struct {
+	Retriever
+	cache *readCache
+}
+
+// Get implements the Retriever interface.
+func (c *cachedRetriever) Get(k Key) ([]byte, error) {
+	if v, tombstone, ok := c.cache.get(k); ok {
+		if tombstone {
+			return nil, ErrNotExist
+		}
+		return v, nil
+	}
+	v, err := c.Retriever.Get(k)
+	if IsErrNotFound(err) {
+		c.cache.put(k, nil, true)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(k, v, false)
+	return v, nil
+}
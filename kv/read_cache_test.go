@@ -0,0 +1,114 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReadCacheScanDoesNotEvictHotSet(t *testing.T) {
+	r := newMockRetriever()
+	for i := 0; i < 4; i++ {
+		r.data[fmt.Sprintf("hot%d", i)] = []byte("v")
+	}
+	bs := NewBufferStoreWithReadCache(r, 0, 4)
+
+	// Warm the hot list: every key needs two Gets to be promoted out of
+	// the cold/probationary list.
+	for i := 0; i < 4; i++ {
+		k := Key(fmt.Sprintf("hot%d", i))
+		bs.Get(k)
+		bs.Get(k)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, found := bs.readCache.get(Key(fmt.Sprintf("hot%d", i))); !found {
+			t.Fatalf("expected hot%d to be promoted to hot after two touches", i)
+		}
+	}
+
+	// A scan over many distinct, never-repeated keys must not evict any of
+	// the already-hot keys: they should only ever land in cold/ghost.
+	for i := 0; i < 1000; i++ {
+		k := Key(fmt.Sprintf("scan%d", i))
+		r.data[string(k)] = []byte("v")
+		bs.Get(k)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, _, found := bs.readCache.get(Key(fmt.Sprintf("hot%d", i))); !found {
+			t.Fatalf("hot%d was evicted by a scan over distinct keys, cache is not scan-resistant", i)
+		}
+	}
+}
+
+func TestReadCacheInvalidateOnWrite(t *testing.T) {
+	r := newMockRetriever()
+	r.data["k"] = []byte("old")
+	bs := NewBufferStoreWithReadCache(r, 0, 16)
+
+	bs.Get(Key("k"))
+	bs.Get(Key("k")) // promote to hot
+
+	if err := bs.Set(Key("k"), []byte("new")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if _, _, found := bs.readCache.get(Key("k")); found {
+		t.Fatal("expected Set to drop k from the read cache")
+	}
+	v, err := bs.Get(Key("k"))
+	if err != nil || string(v) != "new" {
+		t.Fatalf("expected %q after invalidation, got %q, err %v", "new", v, err)
+	}
+}
+
+func BenchmarkReadCachePointLookup(b *testing.B) {
+	r := newMockRetriever()
+	const keySpace = 64
+	for i := 0; i < keySpace; i++ {
+		r.data[fmt.Sprintf("k%d", i)] = []byte(fmt.Sprintf("v%d", i))
+	}
+	bs := NewBufferStoreWithReadCache(r, 0, keySpace)
+	// Warm every key into the hot list.
+	for i := 0; i < keySpace; i++ {
+		k := Key(fmt.Sprintf("k%d", i))
+		bs.Get(k)
+		bs.Get(k)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := Key(fmt.Sprintf("k%d", i%keySpace))
+		if _, err := bs.Get(k); err != nil {
+			b.Fatalf("Get failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkNoReadCachePointLookup(b *testing.B) {
+	r := newMockRetriever()
+	const keySpace = 64
+	for i := 0; i < keySpace; i++ {
+		r.data[fmt.Sprintf("k%d", i)] = []byte(fmt.Sprintf("v%d", i))
+	}
+	bs := NewBufferStore(r, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := Key(fmt.Sprintf("k%d", i%keySpace))
+		if _, err := bs.Get(k); err != nil {
+			b.Fatalf("Get failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import "testing"
+
+func TestWriteBatchIterateRoundtrip(t *testing.T) {
+	b := NewWriteBatch()
+	b.Put(Key("a"), []byte("1"))
+	b.Delete(Key("b"))
+	b.Put(Key("c"), []byte("3"))
+
+	type rec struct {
+		k        string
+		v        string
+		isDelete bool
+	}
+	var got []rec
+	err := b.Iterate(func(k Key, v []byte, isDelete bool) error {
+		got = append(got, rec{k: string(k), v: string(v), isDelete: isDelete})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate failed: %v", err)
+	}
+	want := []rec{{"a", "1", false}, {"b", "", true}, {"c", "3", false}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("record %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMemDbBufferWriteRejectsOversizedEntry(t *testing.T) {
+	m := NewMemDbBuffer(0).(*memDbBuffer)
+	m.entrySizeLimit = 4
+
+	b := NewWriteBatch()
+	b.Put(Key("k"), []byte("too-large-value"))
+
+	err := m.Write(b)
+	if err == nil {
+		t.Fatal("expected Write to reject an entry larger than entrySizeLimit")
+	}
+	if _, getErr := m.Get(Key("k")); !IsErrNotFound(getErr) {
+		t.Fatalf("rejected entry must not have been applied, got %v", getErr)
+	}
+}
+
+func TestMemDbBufferWriteRejectsBatchIfAnyEntryOversized(t *testing.T) {
+	m := NewMemDbBuffer(0).(*memDbBuffer)
+	m.entrySizeLimit = 4
+
+	b := NewWriteBatch()
+	b.Put(Key("k1"), []byte("ok"))
+	b.Put(Key("k2"), []byte("too-large-value"))
+
+	err := m.Write(b)
+	if err == nil {
+		t.Fatal("expected Write to reject a batch containing an oversized entry")
+	}
+	if _, getErr := m.Get(Key("k1")); !IsErrNotFound(getErr) {
+		t.Fatalf("entry preceding the oversized one must not have been applied, got %v", getErr)
+	}
+	if _, getErr := m.Get(Key("k2")); !IsErrNotFound(getErr) {
+		t.Fatalf("oversized entry must not have been applied, got %v", getErr)
+	}
+}
+
+func TestMemDbBufferWriteRejectsEmptyValue(t *testing.T) {
+	m := NewMemDbBuffer(0).(*memDbBuffer)
+
+	b := NewWriteBatch()
+	b.Put(Key("k"), []byte{})
+
+	err := m.Write(b)
+	if err == nil {
+		t.Fatal("expected Write to reject a Put with an empty value, like Set does")
+	}
+	if _, getErr := m.Get(Key("k")); !IsErrNotFound(getErr) {
+		t.Fatalf("rejected entry must not have been applied, got %v", getErr)
+	}
+}
+
+func TestMemDbBufferWriteAppliesBatchAtomically(t *testing.T) {
+	m := NewMemDbBuffer(0).(*memDbBuffer)
+
+	b := NewWriteBatch()
+	b.Put(Key("a"), []byte("1"))
+	b.Put(Key("b"), []byte("2"))
+	b.Delete(Key("a"))
+
+	if err := m.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := m.Get(Key("a")); err != nil {
+		t.Fatalf("expected tombstone (no error, empty value) for deleted key, got err %v", err)
+	}
+	v, err := m.Get(Key("b"))
+	if err != nil || string(v) != "2" {
+		t.Fatalf("expected %q for key b, got %q, err %v", "2", v, err)
+	}
+}
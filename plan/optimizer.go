@@ -14,6 +14,7 @@
 package plan
 
 import (
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"math"
 	"reflect"
@@ -60,6 +61,7 @@ type logicalOptRule interface {
 // The node must be prepared first.
 func Optimize(ctx sessionctx.Context, node ast.Node, is infoschema.InfoSchema) (Plan, error) {
 	logrus.Infof("------------------ step into optimize ")
+	checkSchemaVersionForPlanCache(is)
 	ctx.GetSessionVars().PlanID = 0
 	builder := &planBuilder{
 		ctx:       ctx,
@@ -86,11 +88,38 @@ func Optimize(ctx sessionctx.Context, node ast.Node, is infoschema.InfoSchema) (
 
 	// code_analysis 优化主要是为select准备的
 	if logic, ok := p.(LogicalPlan); ok {
-		return doOptimize(builder.optFlag, logic)
+		if !PlanCacheEnabled {
+			return doOptimize(builder.optFlag, logic)
+		}
+		key := planCacheKeyForNode(node, is, ctx)
+		if cached, ok := globalPlanCache.Get(key); ok {
+			logrus.Infof("plan cache hit")
+			// Get already handed back a private copy of the cached plan
+			// tree, so re-resolving indices on it can't race with any other
+			// execution of the same cache entry.
+			cached.ResolveIndices()
+			return cached, nil
+		}
+		physical, err := doOptimize(builder.optFlag, logic)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		globalPlanCache.Put(key, physical, visitedTables(builder.visitInfo))
+		return physical, nil
 	} else {
 		logrus.Infof("insert will not trigger optimize, not a logical plan")
 	}
 	if execPlan, ok := p.(*Execute); ok {
+		// Deliberately out of PlanCache's scope, not a pending TODO: see the
+		// "Scope" note on the PlanCache doc comment. optimizePreparedPlan
+		// substitutes this execution's bound parameter values straight into
+		// the logical/physical tree as Constants, so the resulting
+		// PhysicalPlan is only valid for these exact values. Caching it
+		// under a type-only key (as an earlier version of this code did)
+		// handed a later execution with different bound values a plan still
+		// carrying the first execution's constants - silent wrong-result
+		// corruption, not a cache-miss - which is why every execution
+		// re-optimizes instead.
 		err := execPlan.optimizePreparedPlan(ctx, is)
 		return p, errors.Trace(err)
 	} else {
@@ -115,6 +144,24 @@ func BuildLogicalPlan(ctx sessionctx.Context, node ast.Node, is infoschema.InfoS
 	return p, nil
 }
 
+// visitedTables returns the deduplicated "db.table" identifiers vs
+// references, so PlanCache.Put can record which tables a cached plan was
+// costed against and OnStatsUpdated can invalidate just the entries that
+// depend on a table whose statistics changed, instead of the whole cache.
+func visitedTables(vs []visitInfo) []string {
+	seen := make(map[string]struct{}, len(vs))
+	var tables []string
+	for _, v := range vs {
+		t := fmt.Sprintf("%v.%v", v.db, v.table)
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		tables = append(tables, t)
+	}
+	return tables
+}
+
 func checkPrivilege(pm privilege.Manager, vs []visitInfo) bool {
 	logrus.Infof("check privilege by visitinfo: %s", vs)
 	for _, v := range vs {
@@ -0,0 +1,368 @@
+// Copyright 2015 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/tidb/ast"
+	"github.com/pingcap/tidb/infoschema"
+	"github.com/pingcap/tidb/sessionctx"
+)
+
+// PlanCacheCapacity is the default number of physical plans kept in a
+// PlanCache, counting its hot and cold lists together.
+var PlanCacheCapacity = 1000
+
+// PlanCacheEnabled toggles whether Optimize consults/populates
+// globalPlanCache for plain (non-prepared) statements. It is a package-level
+// switch, mirroring AllowCartesianProduct, rather than a sessionctx.Context
+// session variable, since that session variable lives outside this package
+// and isn't registered anywhere in this tree. Prepared statements never
+// consult globalPlanCache regardless of this switch - see the comment on
+// the *Execute branch of Optimize for why.
+var PlanCacheEnabled = true
+
+// planCacheKey fingerprints a statement's text together with the
+// schema version and session variables that can change the physical plan
+// doOptimize produces for it.
+type planCacheKey [sha256.Size]byte
+
+// newPlanCacheKey hashes together the statement text, the schema version
+// and a caller-supplied digest of the session variables relevant to
+// planning.
+func newPlanCacheKey(stmtText string, schemaVersion int64, varsDigest string) planCacheKey {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", stmtText, schemaVersion, varsDigest)
+	var key planCacheKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// planCacheEntry is a node in the two-list hot/cold LRU.
+type planCacheEntry struct {
+	key    planCacheKey
+	plan   PhysicalPlan
+	tables []string // "db.table" identifiers the plan was costed against
+	hot    bool
+	prev   *planCacheEntry
+	next   *planCacheEntry
+}
+
+// PlanCache is an LRU-bounded cache of PhysicalPlan keyed by a fingerprint
+// of the statement text, the schema version and relevant session vars. It
+// follows the two-list (hot/cold) eviction design goleveldb's block cache
+// uses: an entry starts on the cold list when Put, and only gets promoted
+// to the hot list on its first Get hit after that, so a single scan over
+// cold, once-touched plans cannot flush out the hot, repeatedly-executed
+// plans.
+//
+// Scope: this memoizes plain statements only. A prepared statement's
+// PhysicalPlan has its bound parameter values substituted in as Constants
+// by optimizePreparedPlan, so a plan cached for one execution's values is
+// not a valid cache hit for the next execution's - reusing it needs
+// per-execution constant rebinding, which optimizePreparedPlan doesn't
+// expose a hook for in this tree. Optimize's *Execute branch re-optimizes
+// every execution instead of risking that correctness bug.
+type PlanCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[planCacheKey]*planCacheEntry
+
+	hotHead, hotTail   *planCacheEntry
+	coldHead, coldTail *planCacheEntry
+	hotLen, coldLen    int
+
+	hits   int64
+	misses int64
+}
+
+// NewPlanCache creates a PlanCache holding up to capacity plans.
+func NewPlanCache(capacity int) *PlanCache {
+	if capacity <= 0 {
+		capacity = PlanCacheCapacity
+	}
+	return &PlanCache{
+		capacity: capacity,
+		entries:  make(map[planCacheKey]*planCacheEntry),
+	}
+}
+
+// clonablePlan is implemented by PhysicalPlan nodes that can deep-copy
+// themselves. PlanCache.Get needs this to hand every caller its own plan
+// tree: two concurrent executions of the same cached statement must not call ResolveIndices on, or execute, the very same
+// plan-node objects.
+//
+// This has to be a per-node Clone, not a generic reflective walk: a
+// PhysicalPlan's basePlan carries the live sessionctx.Context (so it, and
+// everything reachable from it - the session, its txn, the domain, the
+// store - would be copied too, and that object graph has back-references
+// a generic walker can't know to stop at), and plan nodes share
+// *expression.Column pointers between a parent's conditions and a child's
+// schema on purpose; blindly duplicating every pointer would give the
+// clone two different Column objects where ResolveIndices and the
+// executor require one. Only a node itself knows which of its fields are
+// safe to deep-copy (its own slices of children/conditions) and which must
+// be shared or substituted (ctx, schema columns), so Clone has to be
+// implemented per concrete node type rather than derived generically.
+type clonablePlan interface {
+	Clone() PhysicalPlan
+}
+
+// Get looks up the cached plan for key. A hit promotes cold entries to the
+// hot list and moves hot entries to the front of the hot list. The
+// returned plan is always a fresh copy owned by the caller; if the cached
+// plan doesn't know how to clone itself, Get reports a miss instead of
+// handing out a pointer that could race with another execution.
+func (c *PlanCache) Get(key planCacheKey) (PhysicalPlan, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	if e.hot {
+		c.unlinkHot(e)
+		c.pushHotFront(e)
+	} else {
+		c.unlinkCold(e)
+		e.hot = true
+		c.pushHotFront(e)
+		c.hotLen++
+		c.coldLen--
+		c.evictHotIfNeeded()
+	}
+	plan := e.plan
+	c.mu.Unlock()
+
+	cloneable, ok := plan.(clonablePlan)
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return cloneable.Clone(), true
+}
+
+// Put inserts or overwrites the plan cached under key, starting it out on
+// the cold list and recording tables (the "db.table" identifiers it was
+// costed against) so a later PurgeTable can invalidate just the entries
+// that depend on a table whose statistics changed. p that doesn't
+// implement clonablePlan is never stored: Get can only ever hand such a
+// plan back as a permanent miss, so caching it would just pay hot/cold
+// bookkeeping cost for an entry that can never produce a real hit.
+func (c *PlanCache) Put(key planCacheKey, p PhysicalPlan, tables []string) {
+	if _, ok := p.(clonablePlan); !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.plan = p
+		e.tables = tables
+		return
+	}
+	e := &planCacheEntry{key: key, plan: p, tables: tables}
+	c.entries[key] = e
+	c.pushColdFront(e)
+	c.coldLen++
+	c.evictColdIfNeeded()
+}
+
+// Purge drops every cached plan. It is called (through InvalidatePlanCache)
+// whenever the InfoSchema version changes, since that can change which
+// physical plan is optimal. A statistics refresh goes through PurgeTable
+// instead.
+func (c *PlanCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[planCacheKey]*planCacheEntry)
+	c.hotHead, c.hotTail = nil, nil
+	c.coldHead, c.coldTail = nil, nil
+	c.hotLen, c.coldLen = 0, 0
+}
+
+// PurgeTable drops every cached plan recorded (via Put) as having been
+// costed against table, a "db.table" identifier, leaving entries for
+// unrelated tables untouched. Unlike Purge, this doesn't have to evict the
+// whole cache just because one table's statistics changed.
+func (c *PlanCache) PurgeTable(table string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		for _, t := range e.tables {
+			if t != table {
+				continue
+			}
+			if e.hot {
+				c.unlinkHot(e)
+				c.hotLen--
+			} else {
+				c.unlinkCold(e)
+				c.coldLen--
+			}
+			delete(c.entries, key)
+			break
+		}
+	}
+}
+
+// HitCount returns the number of Get calls that found a cached plan.
+func (c *PlanCache) HitCount() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// MissCount returns the number of Get calls that found nothing cached.
+func (c *PlanCache) MissCount() int64 {
+	return atomic.LoadInt64(&c.misses)
+}
+
+func (c *PlanCache) evictHotIfNeeded() {
+	for c.hotLen+c.coldLen > c.capacity && c.hotTail != nil {
+		victim := c.hotTail
+		c.unlinkHot(victim)
+		c.hotLen--
+		delete(c.entries, victim.key)
+	}
+}
+
+func (c *PlanCache) evictColdIfNeeded() {
+	for c.hotLen+c.coldLen > c.capacity && c.coldTail != nil {
+		victim := c.coldTail
+		c.unlinkCold(victim)
+		c.coldLen--
+		delete(c.entries, victim.key)
+	}
+}
+
+func (c *PlanCache) pushHotFront(e *planCacheEntry) {
+	e.prev, e.next = nil, c.hotHead
+	if c.hotHead != nil {
+		c.hotHead.prev = e
+	}
+	c.hotHead = e
+	if c.hotTail == nil {
+		c.hotTail = e
+	}
+}
+
+func (c *PlanCache) pushColdFront(e *planCacheEntry) {
+	e.prev, e.next = nil, c.coldHead
+	if c.coldHead != nil {
+		c.coldHead.prev = e
+	}
+	c.coldHead = e
+	if c.coldTail == nil {
+		c.coldTail = e
+	}
+}
+
+func (c *PlanCache) unlinkHot(e *planCacheEntry) {
+	c.unlink(e, &c.hotHead, &c.hotTail)
+}
+
+func (c *PlanCache) unlinkCold(e *planCacheEntry) {
+	c.unlink(e, &c.coldHead, &c.coldTail)
+}
+
+func (c *PlanCache) unlink(e *planCacheEntry, head, tail **planCacheEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		*head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		*tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+// globalPlanCache is the process-wide cache consulted by Optimize. It is a
+// package-level variable, mirroring how optRuleList is shared across all
+// callers, rather than per-session state; varsDigestForOptimize is what
+// keeps entries from different sessions with a different current database
+// from colliding under one shared cache, while still letting two
+// connections share a cached plan for byte-identical statements.
+var globalPlanCache = NewPlanCache(PlanCacheCapacity)
+
+// InvalidatePlanCache drops every cached physical plan. Callers should
+// invoke this whenever an infoschema.InfoSchema version bump or a
+// statistics refresh could change which plan is optimal for a cached key.
+func InvalidatePlanCache() {
+	globalPlanCache.Purge()
+}
+
+// OnStatsUpdated must be called whenever statistics for db.table are
+// refreshed (e.g. after ANALYZE TABLE completes or the stats handle loads
+// a new snapshot for it). It purges only the cached plans recorded as
+// depending on that table, leaving plans over other tables untouched.
+// Cached entries don't otherwise carry any signal that the table stats
+// they were costed against changed, so without this call they would keep
+// serving until capacity pressure aged them out.
+//
+// Nothing in this package calls OnStatsUpdated: wiring it up to the actual
+// stats-refresh path (stats handle / ANALYZE completion) lives in the
+// statistics package, which this tree doesn't include.
+func OnStatsUpdated(db, table string) {
+	globalPlanCache.PurgeTable(fmt.Sprintf("%v.%v", db, table))
+}
+
+// lastSeenSchemaVersion is compared against on every Optimize call so a
+// version bump proactively purges the cache instead of just letting the
+// now-stale entries linger, unreachable, until they age out on their own.
+var lastSeenSchemaVersion = int64(-1)
+
+// checkSchemaVersionForPlanCache purges globalPlanCache the first time it
+// observes is at a schema version different from the last one it saw.
+func checkSchemaVersionForPlanCache(is infoschema.InfoSchema) {
+	v := is.SchemaMetaVersion()
+	old := atomic.SwapInt64(&lastSeenSchemaVersion, v)
+	if old != -1 && old != v {
+		InvalidatePlanCache()
+	}
+}
+
+// PlanCacheHitCount and PlanCacheMissCount expose the global cache's
+// counters for status reporting.
+func PlanCacheHitCount() int64  { return globalPlanCache.HitCount() }
+func PlanCacheMissCount() int64 { return globalPlanCache.MissCount() }
+
+// varsDigestForOptimize builds the part of the cache key that depends on
+// session state able to change doOptimize's output: the cartesian product
+// switch (process-wide), and the session's current database, since an
+// unqualified table reference resolves differently depending on which
+// database is selected. Deliberately excludes the session's connection ID:
+// two connections running byte-identical SQL against the same database
+// should be able to share one cached plan, and keying on ConnectionID
+// would mean no plan is ever reused across connections.
+func varsDigestForOptimize(ctx sessionctx.Context) string {
+	vars := ctx.GetSessionVars()
+	return fmt.Sprintf("cartesian=%v;db=%s", AllowCartesianProduct, vars.CurrentDB)
+}
+
+// planCacheKeyForNode builds the cache key used for a plain (non-prepared)
+// statement: its text exactly as node.Text() returns it, the schema version
+// it was built against, and the session variable digest. The text is not
+// normalized, so statements that differ only in whitespace or letter case
+// get separate cache entries.
+func planCacheKeyForNode(node ast.Node, is infoschema.InfoSchema, ctx sessionctx.Context) planCacheKey {
+	return newPlanCacheKey(node.Text(), is.SchemaMetaVersion(), varsDigestForOptimize(ctx))
+}
+